@@ -0,0 +1,91 @@
+package fs
+
+import "testing"
+
+func TestCoalesceEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+		want   []map[string]interface{}
+	}{
+		{
+			name: "create then remove of the same name cancels out",
+			events: []Event{
+				{Name: "/tmp/a", Op: OpCreate},
+				{Name: "/tmp/a", Op: OpRemove},
+			},
+			want: nil,
+		},
+		{
+			name: "create followed by writes is still just added",
+			events: []Event{
+				{Name: "/tmp/a", Op: OpCreate},
+				{Name: "/tmp/a", Op: OpWrite},
+				{Name: "/tmp/a", Op: OpWrite},
+			},
+			want: []map[string]interface{}{
+				{"event": "added"},
+			},
+		},
+		{
+			name: "repeated writes become a single modified",
+			events: []Event{
+				{Name: "/tmp/a", Op: OpWrite},
+				{Name: "/tmp/a", Op: OpWrite},
+			},
+			want: []map[string]interface{}{
+				{"event": "modified"},
+			},
+		},
+		{
+			name: "rename immediately followed by create is renamed",
+			events: []Event{
+				{Name: "/tmp/old", Op: OpRename},
+				{Name: "/tmp/new", Op: OpCreate},
+			},
+			want: []map[string]interface{}{
+				{"event": "renamed", "oldPath": "/tmp/old"},
+			},
+		},
+		{
+			name: "rename never paired with a create is a removal",
+			events: []Event{
+				{Name: "/tmp/moved-away", Op: OpRename},
+			},
+			want: []map[string]interface{}{
+				{"event": "removed"},
+			},
+		},
+		{
+			name: "rename paired with a create in a later batch is still a removal here",
+			events: []Event{
+				{Name: "/tmp/moved-away", Op: OpRename},
+				{Name: "/tmp/unrelated", Op: OpWrite},
+			},
+			want: []map[string]interface{}{
+				{"event": "modified"},
+				{"event": "removed"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coalesceEvents(tt.events)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("coalesceEvents() = %d events, want %d: %+v", len(got), len(tt.want), got)
+			}
+
+			for i, want := range tt.want {
+				if got[i]["event"] != want["event"] {
+					t.Errorf("event %d: got %q, want %q", i, got[i]["event"], want["event"])
+				}
+
+				if wantOld, ok := want["oldPath"]; ok && got[i]["oldPath"] != wantOld {
+					t.Errorf("event %d: oldPath = %q, want %q", i, got[i]["oldPath"], wantOld)
+				}
+			}
+		})
+	}
+}
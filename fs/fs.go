@@ -4,30 +4,329 @@ package fs
 
 import (
 	"errors"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/koding/klient/Godeps/_workspace/src/github.com/koding/kite"
 	"github.com/koding/klient/Godeps/_workspace/src/github.com/koding/kite/dnode"
-	"github.com/koding/klient/Godeps/_workspace/src/gopkg.in/fsnotify.v1"
 )
 
-var (
-	once               sync.Once // watcher variables
-	newPaths, oldPaths = make(chan string), make(chan string)
+// defaultDebounce is used when ReadDirectory is called without a
+// DebounceMs, coalescing bursts of events (e.g. a `git checkout`) into a
+// single batch instead of flooding the client.
+const defaultDebounce = 300 * time.Millisecond
 
-	// Limit of watching folders
-	// user -> path callbacks
-	watchCallbacks = make(map[string]map[string]func(fsnotify.Event), 100)
-	mu             sync.Mutex // protects watchCallbacks
+var (
+	once     sync.Once // notifier variable
+	notifier Notifier
+
+	// watchCallbacks maps a watched root path to the subscriptions that
+	// want to hear about events happening under it. Every root is backed
+	// by exactly one Notifier.Watch call and one dispatch goroutine, no
+	// matter how many subscriptions share it.
+	watchCallbacks = make(map[string]map[string]*subscription, 100)
+	mu             sync.Mutex // protects watchCallbacks, watchCountByUser and watchCountTotal
+
+	// watchCountByUser and watchCountTotal track how many watch-budget
+	// slots are currently charged -- one per open subscription, plus a
+	// recursive root's extra descriptors and a recursive poll's snapshot
+	// size -- so a single misbehaving client can't exhaust
+	// the process' watch table -- fsnotify/inotify inherits the OS'
+	// fs.inotify.max_user_watches cap and we have no accounting of our
+	// own otherwise.
+	watchCountByUser = make(map[string]int)
+	watchCountTotal  int
+
+	// rootCosts records, for a root with an open subscription, how many
+	// watch descriptors Notifier.Count reported beyond the flat 1 every
+	// subscription is normally charged, and which user's subscription is
+	// actually paying for them. A recursive fsnotify watch can add one
+	// inotify/kqueue descriptor per subdirectory, so this can be large;
+	// it's released back to owner once the root's last subscriber leaves
+	// and the underlying watch is torn down.
+	rootCosts = make(map[string]rootCost)
+
+	// rootRecursive records whether a root's shared watch currently covers
+	// its whole subtree. A later subscriber asking for Recursive on a root
+	// that's only watched top-level triggers upgradeRootToRecursiveLocked,
+	// which re-Watches the root recursively so that subscriber actually
+	// gets subtree events instead of silently missing them.
+	rootRecursive = make(map[string]bool)
+
+	// rootReconcileStop holds the stop channel for a recursive root's
+	// reconcileRootCost goroutine, keyed by root. It exists for exactly as
+	// long as the root has an open recursive subscription.
+	rootReconcileStop = make(map[string]chan struct{})
+
+	maxWatchesPerUser int // 0 means unlimited
+	maxWatchesTotal   int // 0 means unlimited
 )
 
+// rootCost is the extra per-root charge tracked in rootCosts.
+type rootCost struct {
+	owner string
+	extra int
+}
+
+func ensureNotifier() {
+	notifier = newNotifier()
+}
+
+// Configure sets the package-wide watch limits. Zero means unlimited,
+// which is the default. It is meant to be called once during startup,
+// before any ReadDirectory call with OnChange set.
+func Configure(maxPerUser, maxTotal int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	maxWatchesPerUser = maxPerUser
+	maxWatchesTotal = maxTotal
+}
+
+// checkLimitLocked reports whether username may open one more watch
+// descriptor without exceeding either configured limit. Callers must hold
+// mu.
+func checkLimitLocked(username string) error {
+	return watchBudgetErrorLocked(username, 1)
+}
+
+// watchBudgetErrorLocked reports whether granting username n more watch
+// descriptors would exceed either configured limit -- n is 1 for a plain
+// subscription, but can be much larger for a recursive one, which fans out
+// across many real inotify/kqueue watches (see Notifier.Count). Callers
+// must hold mu.
+func watchBudgetErrorLocked(username string, n int) error {
+	if maxWatchesTotal > 0 && watchCountTotal+n > maxWatchesTotal {
+		return &kite.Error{
+			Type:    "watchLimitExceeded",
+			Message: "global watch limit reached",
+		}
+	}
+
+	if maxWatchesPerUser > 0 && watchCountByUser[username]+n > maxWatchesPerUser {
+		return &kite.Error{
+			Type:    "watchLimitExceeded",
+			Message: "watch limit reached for user " + username,
+		}
+	}
+
+	return nil
+}
+
+// WatchStats reports how many watch-budget slots are currently charged
+// (see watchCountByUser), overall and per user, so a runaway watcher can
+// be spotted from the outside.
+func WatchStats(r *kite.Request) (interface{}, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	perUser := make(map[string]int, len(watchCountByUser))
+	for username, count := range watchCountByUser {
+		perUser[username] = count
+	}
+
+	return map[string]interface{}{
+		"total":   watchCountTotal,
+		"perUser": perUser,
+	}, nil
+}
+
+// subscription is a single ReadDirectory call with OnChange set.
+type subscription struct {
+	username  string
+	root      string
+	recursive bool
+	onChange  func([]map[string]interface{})
+
+	// pollInterval is non-zero when this subscription is served by
+	// pollWatchStrategy instead of notifyWatchStrategy, either because
+	// the caller asked for it or because root's filesystem was
+	// auto-detected as one that doesn't deliver kernel notifications.
+	pollInterval time.Duration
+	pollStop     chan struct{}
+
+	// watchCost is how many watch-budget slots pollWatchStrategy.attach
+	// charged this subscription -- 1 normally, or the size of the initial
+	// recursive snapshot for a recursive one, since that's roughly
+	// proportional to the real filepath.Walk cost paid on every tick.
+	// pollWatchStrategy.detach releases exactly this many back.
+	watchCost int
+
+	// detachOnce guards pollWatchStrategy.detach: ReadDirectory wires the
+	// same removePath closure to both the client's OnDisconnect and the
+	// stopWatching dnode callback, so an ordinary stopWatching-then-
+	// disconnect sequence calls detach twice on the same subscription.
+	// Without this, the second call closes an already-closed pollStop and
+	// double-releases the watch budget.
+	detachOnce sync.Once
+
+	debounce time.Duration
+	bufMu    sync.Mutex
+	buffer   []Event
+	timer    *time.Timer
+}
+
+// watchStrategy is how a subscription discovers filesystem changes under
+// its root and feeds them to sub.enqueue, until detach is called.
+type watchStrategy interface {
+	attach(sub *subscription) error
+	detach(sub *subscription) error
+}
+
+// enqueue buffers a backend event and (re)arms the debounce timer. Events
+// are coalesced and delivered as a single batch by flush once the subtree
+// has been quiet for sub.debounce.
+func (sub *subscription) enqueue(ev Event) {
+	sub.bufMu.Lock()
+	defer sub.bufMu.Unlock()
+
+	sub.buffer = append(sub.buffer, ev)
+
+	if sub.timer == nil {
+		sub.timer = time.AfterFunc(sub.debounce, sub.flush)
+	} else {
+		sub.timer.Reset(sub.debounce)
+	}
+}
+
+// flush coalesces the buffered events into a batch and delivers it through
+// onChange. Called from the debounce timer's own goroutine.
+func (sub *subscription) flush() {
+	sub.bufMu.Lock()
+	events := sub.buffer
+	sub.buffer = nil
+	sub.timer = nil
+	sub.bufMu.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+
+	if batch := coalesceEvents(events); len(batch) > 0 {
+		sub.onChange(batch)
+	}
+}
+
+// coalescedEvent is the net effect, within one debounce window, of
+// everything that happened to a single path.
+type coalescedEvent struct {
+	kind    string // added, removed, modified or renamed
+	name    string
+	oldName string
+}
+
+// coalesceEvents collapses a burst of backend events into the minimal set
+// of changes a client actually needs to know about: a CREATE+REMOVE pair
+// of the same name cancels out, CREATE followed by one or more WRITEs is
+// still just "added", repeated WRITEs become a single "modified", and a
+// Rename immediately followed by a Create is reported as "renamed"
+// (fsnotify, and our OpRename/OpCreate translation of it, splits an
+// OS-level rename into exactly that pair).
+func coalesceEvents(events []Event) []map[string]interface{} {
+	var order []string
+	byName := make(map[string]*coalescedEvent)
+	var pendingRenames []string
+
+	touch := func(name string, ce *coalescedEvent) {
+		if _, ok := byName[name]; !ok {
+			order = append(order, name)
+		}
+		byName[name] = ce
+	}
+
+	for _, ev := range events {
+		switch {
+		case ev.Op&OpRename != 0:
+			pendingRenames = append(pendingRenames, ev.Name)
+
+		case ev.Op&OpCreate != 0:
+			if len(pendingRenames) > 0 {
+				oldName := pendingRenames[0]
+				pendingRenames = pendingRenames[1:]
+				delete(byName, oldName)
+				touch(ev.Name, &coalescedEvent{kind: "renamed", name: ev.Name, oldName: oldName})
+				continue
+			}
+
+			if existing, ok := byName[ev.Name]; ok && existing.kind == "removed" {
+				delete(byName, ev.Name)
+				continue
+			}
+
+			touch(ev.Name, &coalescedEvent{kind: "added", name: ev.Name})
+
+		case ev.Op&OpRemove != 0:
+			if existing, ok := byName[ev.Name]; ok && existing.kind == "added" {
+				delete(byName, ev.Name)
+				continue
+			}
+
+			touch(ev.Name, &coalescedEvent{kind: "removed", name: ev.Name})
+
+		case ev.Op&OpWrite != 0:
+			if existing, ok := byName[ev.Name]; ok && (existing.kind == "added" || existing.kind == "renamed") {
+				continue
+			}
+
+			touch(ev.Name, &coalescedEvent{kind: "modified", name: ev.Name})
+		}
+	}
+
+	// Any rename left unpaired -- moved out of the watched directory
+	// entirely, or paired with a Create that lands in the next debounce
+	// window instead of this one -- is a removal as far as this batch is
+	// concerned.
+	for _, oldName := range pendingRenames {
+		touch(oldName, &coalescedEvent{kind: "removed", name: oldName})
+	}
+
+	batch := make([]map[string]interface{}, 0, len(order))
+	for _, name := range order {
+		ce, ok := byName[name]
+		if !ok {
+			continue
+		}
+		batch = append(batch, ce.toEvent())
+	}
+
+	return batch
+}
+
+func (ce *coalescedEvent) toEvent() map[string]interface{} {
+	switch ce.kind {
+	case "removed":
+		return map[string]interface{}{
+			"event": "removed",
+			"file":  NewFileEntry(path.Base(ce.name), ce.name),
+		}
+	case "renamed":
+		fileEntry, _ := getInfo(ce.name)
+		return map[string]interface{}{
+			"event":   "renamed",
+			"file":    fileEntry,
+			"oldPath": ce.oldName,
+		}
+	default: // added, modified
+		fileEntry, _ := getInfo(ce.name)
+		return map[string]interface{}{
+			"event": ce.kind,
+			"file":  fileEntry,
+		}
+	}
+}
+
 func ReadDirectory(r *kite.Request) (interface{}, error) {
 	var params struct {
-		Path     string
-		OnChange dnode.Function
+		Path         string
+		OnChange     dnode.Function
+		Recursive    bool
+		DebounceMs   int
+		PollInterval time.Duration
 	}
 
 	if r.Args == nil {
@@ -36,74 +335,44 @@ func ReadDirectory(r *kite.Request) (interface{}, error) {
 
 	if r.Args.One().Unmarshal(&params) != nil || params.Path == "" {
 		log.Println("params", params)
-		return nil, errors.New("{ path: [string], onChange: [function]}")
+		return nil, errors.New("{ path: [string], onChange: [function], recursive: [bool], debounceMs: [integer], pollInterval: [duration in ns] }")
 	}
 
 	response := make(map[string]interface{})
 
 	if params.OnChange.IsValid() {
-		onceBody := func() { startWatcher() }
-		go once.Do(onceBody)
-
-		var eventType string
-		var fileEntry *FileEntry
-
-		changer := func(ev fsnotify.Event) {
-			switch ev.Op {
-			case fsnotify.Create:
-				eventType = "added"
-				fileEntry, _ = getInfo(ev.Name)
-			case fsnotify.Remove, fsnotify.Rename:
-				eventType = "removed"
-				fileEntry = NewFileEntry(path.Base(ev.Name), ev.Name)
-			}
+		once.Do(ensureNotifier)
 
-			event := map[string]interface{}{
-				"event": eventType,
-				"file":  fileEntry,
-			}
+		debounce := defaultDebounce
+		if params.DebounceMs > 0 {
+			debounce = time.Duration(params.DebounceMs) * time.Millisecond
+		}
 
-			// send back the result to the client
-			params.OnChange.Call(event)
-			return
+		pollInterval := params.PollInterval
+		if pollInterval == 0 && isUnwatchableMount(params.Path) {
+			pollInterval = defaultPollInterval
 		}
 
-		// first check if are watching the path, if not send it to the watcher
-		mu.Lock()
-		userCallbacks, ok := watchCallbacks[params.Path]
-		if !ok {
-			// notify new paths to the watcher
-			newPaths <- params.Path
+		sub := &subscription{
+			username:     r.Username,
+			root:         params.Path,
+			recursive:    params.Recursive,
+			debounce:     debounce,
+			pollInterval: pollInterval,
+		}
+		sub.onChange = func(batch []map[string]interface{}) {
+			// send back the result to the client
+			params.OnChange.Call(batch)
 		}
 
-		// now add the callback to the specific user. If it's already exists we just override
-		_, ok = userCallbacks[r.Username]
-		if !ok {
-			userCallbacks[r.Username] = changer
-			watchCallbacks[params.Path] = userCallbacks
+		strategy := watchStrategyFor(sub)
+
+		if err := strategy.attach(sub); err != nil {
+			return nil, err
 		}
-		mu.Unlock()
 
 		removePath := func() {
-			mu.Lock()
-
-			userCallbacks, ok := watchCallbacks[params.Path]
-			if ok {
-				// delete the user callback function for this path
-				delete(userCallbacks, r.Username)
-
-				// now check if there is any user left back. If we have removed
-				// all users, we should also stop the watcher from watching the
-				// path. So notify the watcher to stop watching the path and
-				// also remove it from the callbacks map
-				if len(userCallbacks) == 0 {
-					// notify the watcher that we are done with this path, because
-					// all users are removed
-					delete(watchCallbacks, params.Path)
-					oldPaths <- params.Path
-				}
-			}
-			mu.Unlock()
+			strategy.detach(sub)
 		}
 
 		// remove the path when the remote client disconnects
@@ -124,49 +393,442 @@ func ReadDirectory(r *kite.Request) (interface{}, error) {
 	return response, nil
 }
 
-func startWatcher() {
-	var err error
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal(err)
+// watchStrategyFor picks how sub should discover changes: polling when
+// the caller asked for it (or root's filesystem can't be trusted to
+// deliver kernel notifications), the shared Notifier otherwise.
+func watchStrategyFor(sub *subscription) watchStrategy {
+	if sub.pollInterval > 0 {
+		return pollWatchStrategy{}
 	}
+	return notifyWatchStrategy{}
+}
 
-	go func() {
-		for {
-			select {
-			case p := <-newPaths:
-				err := watcher.Add(p)
-				if err != nil {
-					log.Println("watch path adding", err)
-				}
-			case p := <-oldPaths:
-				err := watcher.Remove(p)
-				if err != nil {
-					log.Println("watch remove adding", err)
-				}
+// notifyWatchStrategy is the default watchStrategy, backed by the
+// package's shared Notifier (fsnotify or rjeczalik/notify depending on
+// platform). It shares one Notifier.Watch call across every subscription
+// on the same root via watchCallbacks.
+type notifyWatchStrategy struct{}
+
+func (notifyWatchStrategy) attach(sub *subscription) error {
+	return addSubscription(sub)
+}
+
+func (notifyWatchStrategy) detach(sub *subscription) error {
+	removeSubscription(sub)
+	return nil
+}
+
+// addSubscription registers sub with the notifier. The first subscription
+// on a given root starts a single Notifier.Watch call and a dispatch
+// goroutine fanning its events out to watchCallbacks[root]; later
+// subscriptions on the same root just join that fan-out -- unless sub
+// needs the whole subtree and the root so far has only ever been watched
+// top-level, in which case the shared watch is upgraded first so sub
+// actually gets subtree events instead of silently missing them.
+//
+// A recursive Watch can consume far more than one real OS-level watch
+// descriptor -- fsnotifyNotifier adds one inotify/kqueue watch per
+// subdirectory under root -- so once the root is actually watched
+// recursively, it's additionally charged for whatever Notifier.Count
+// reports beyond the usual flat 1, and rejected (tearing the watch back
+// down, or leaving an already-established upgrade in place) if that blows
+// the configured budget.
+func addSubscription(sub *subscription) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	callbacks, ok := watchCallbacks[sub.root]
+	_, alreadySubscribed := callbacks[sub.username]
+
+	if !alreadySubscribed {
+		if err := checkLimitLocked(sub.username); err != nil {
+			return err
+		}
+	}
+
+	var extra int
+	var recosted bool
+
+	switch {
+	case !ok:
+		events, err := notifier.Watch(sub.root, sub.recursive)
+		if err != nil {
+			return err
+		}
+
+		extra = notifier.Count(sub.root) - 1
+		if extra < 0 {
+			extra = 0
+		}
+		recosted = true
+
+		if extra > 0 && !alreadySubscribed {
+			if err := watchBudgetErrorLocked(sub.username, 1+extra); err != nil {
+				notifier.Unwatch(sub.root)
+				return err
+			}
+		}
+
+		callbacks = make(map[string]*subscription)
+		watchCallbacks[sub.root] = callbacks
+		rootRecursive[sub.root] = sub.recursive
+		go dispatch(sub.root, events)
+
+	case sub.recursive && !rootRecursive[sub.root]:
+		events, err := upgradeRootToRecursiveLocked(sub.root)
+		if err != nil {
+			return err
+		}
+
+		extra = notifier.Count(sub.root) - 1
+		if extra < 0 {
+			extra = 0
+		}
+		recosted = true
+
+		if extra > 0 {
+			if err := watchBudgetErrorLocked(sub.username, extra); err != nil {
+				return err
 			}
 		}
-	}()
+
+		if cost, hadCost := rootCosts[sub.root]; hadCost {
+			releaseWatchSlotLocked(cost.owner, cost.extra)
+		}
+
+		go dispatch(sub.root, events)
+	}
+
+	if !alreadySubscribed {
+		watchCountByUser[sub.username]++
+		watchCountTotal++
+	}
+
+	if extra > 0 || (recosted && rootRecursive[sub.root]) {
+		rootCosts[sub.root] = rootCost{owner: sub.username, extra: extra}
+		watchCountByUser[sub.username] += extra
+		watchCountTotal += extra
+	} else if recosted {
+		delete(rootCosts, sub.root)
+	}
+
+	if rootRecursive[sub.root] {
+		if _, running := rootReconcileStop[sub.root]; !running {
+			stop := make(chan struct{})
+			rootReconcileStop[sub.root] = stop
+			go reconcileRootCost(sub.root, stop)
+		}
+	}
+
+	callbacks[sub.username] = sub
+
+	return nil
+}
+
+// upgradeRootToRecursiveLocked re-establishes root's shared Notifier.Watch
+// recursively and restarts its dispatch goroutine, for a root that so far
+// has only ever been watched top-level. Existing subscribers on root are
+// unaffected: dispatch reads watchCallbacks[root] fresh on every event, so
+// swapping the events channel doesn't require touching the subscriber map
+// itself -- the old dispatch goroutine simply exits once Unwatch closes
+// its channel. Callers must hold mu.
+func upgradeRootToRecursiveLocked(root string) (<-chan Event, error) {
+	if err := notifier.Unwatch(root); err != nil {
+		return nil, err
+	}
+
+	events, err := notifier.Watch(root, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rootRecursive[root] = true
+
+	return events, nil
+}
+
+// removeSubscription drops sub from its root's fan-out, unwatching the
+// root entirely once its last subscriber is gone.
+func removeSubscription(sub *subscription) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	callbacks, ok := watchCallbacks[sub.root]
+	if !ok {
+		return
+	}
+
+	if _, exists := callbacks[sub.username]; exists {
+		delete(callbacks, sub.username)
+		releaseWatchSlotLocked(sub.username, 1)
+	}
+
+	if len(callbacks) == 0 {
+		delete(watchCallbacks, sub.root)
+		delete(rootRecursive, sub.root)
+
+		if stop, running := rootReconcileStop[sub.root]; running {
+			delete(rootReconcileStop, sub.root)
+			close(stop)
+		}
+
+		if cost, ok := rootCosts[sub.root]; ok {
+			delete(rootCosts, sub.root)
+			releaseWatchSlotLocked(cost.owner, cost.extra)
+		}
+
+		if err := notifier.Unwatch(sub.root); err != nil {
+			log.Println("unwatch", sub.root, err)
+		}
+	}
+}
+
+// dispatch reads a single root's event channel until the notifier closes
+// it (on Unwatch) and fans every event out to the subscriptions currently
+// registered for that root.
+func dispatch(root string, events <-chan Event) {
+	for ev := range events {
+		mu.Lock()
+		subs := make([]*subscription, 0, len(watchCallbacks[root]))
+		for _, sub := range watchCallbacks[root] {
+			subs = append(subs, sub)
+		}
+		mu.Unlock()
+
+		for _, sub := range subs {
+			sub.enqueue(ev)
+		}
+	}
+}
+
+// defaultPollInterval is used for a subscription that ends up polling
+// (explicitly, or via auto-detection) without naming an interval of its
+// own.
+const defaultPollInterval = 2 * time.Second
+
+// pollWatchStrategy is used for filesystems that don't reliably deliver
+// inotify/kqueue events -- NFS, SMB and FUSE overlays are common
+// offenders. It snapshots root's immediate entries (its whole subtree for a
+// recursive subscription) on a ticker and diffs by name, size and mtime
+// instead of relying on any kernel notification.
+type pollWatchStrategy struct{}
+
+func (pollWatchStrategy) attach(sub *subscription) error {
+	mu.Lock()
+	if err := checkLimitLocked(sub.username); err != nil {
+		mu.Unlock()
+		return err
+	}
+	mu.Unlock()
+
+	prev, err := pollSnapshot(sub.root, sub.recursive)
+	if err != nil {
+		return err
+	}
+
+	// A recursive poll walks the whole subtree on every tick, so charge
+	// it for roughly what that costs instead of a flat 1 -- otherwise a
+	// recursive watch on a huge tree escapes the budget this strategy is
+	// supposed to be bound by just as easily as an unbudgeted recursive
+	// notify watch would.
+	cost := 1
+	if sub.recursive && len(prev) > cost {
+		cost = len(prev)
+	}
+
+	mu.Lock()
+	if err := watchBudgetErrorLocked(sub.username, cost); err != nil {
+		mu.Unlock()
+		return err
+	}
+	watchCountByUser[sub.username] += cost
+	watchCountTotal += cost
+	mu.Unlock()
+
+	sub.watchCost = cost
+	sub.pollStop = make(chan struct{})
+	go pollLoop(sub, prev)
+
+	return nil
+}
+
+func (pollWatchStrategy) detach(sub *subscription) error {
+	sub.detachOnce.Do(func() {
+		mu.Lock()
+		releaseWatchSlotLocked(sub.username, sub.watchCost)
+		mu.Unlock()
+
+		close(sub.pollStop)
+	})
+
+	return nil
+}
+
+// releaseWatchSlotLocked is the inverse of the accounting done in
+// addSubscription/pollWatchStrategy's attach: it gives back n watch
+// descriptors charged to username (1 for a plain subscription leaving,
+// or a root's extra descriptor count once its last subscriber is gone).
+// Callers must hold mu.
+func releaseWatchSlotLocked(username string, n int) {
+	watchCountByUser[username] -= n
+	if watchCountByUser[username] <= 0 {
+		delete(watchCountByUser, username)
+	}
+	watchCountTotal -= n
+}
+
+// watchCostReconcileInterval is how often reconcileRootCost re-prices a
+// recursive root's extra watch-budget charge against how many real
+// descriptors it's actually using.
+const watchCostReconcileInterval = 30 * time.Second
+
+// reconcileRootCost keeps a recursive root's rootCosts entry in sync with
+// reality. addSubscription only prices a root once, at attach (or upgrade)
+// time, but addSubtree/removeSubtree in the fsnotify notifier keep adding
+// and dropping real inotify descriptors as subdirectories come and go
+// under an already-watched recursive root -- so a client can open a cheap
+// watch on a small directory and let it grow to thousands of
+// subdirectories while its accounted cost never moves, exhausting the
+// real descriptor table without ever tripping the budget it's meant to
+// enforce. It runs for as long as rootReconcileStop[root] exists, stopped
+// by removeSubscription once the root's last subscriber leaves.
+func reconcileRootCost(root string, stop <-chan struct{}) {
+	ticker := time.NewTicker(watchCostReconcileInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case event := <-watcher.Events:
+		case <-stop:
+			return
 
+		case <-ticker.C:
 			mu.Lock()
-			f, ok := watchCallbacks[path.Dir(event.Name)]
-			mu.Unlock()
-
+			cost, ok := rootCosts[root]
 			if !ok {
+				mu.Unlock()
 				continue
 			}
 
-			f(event)
+			current := notifier.Count(root) - 1
+			if current < 0 {
+				current = 0
+			}
+
+			if delta := current - cost.extra; delta != 0 {
+				rootCosts[root] = rootCost{owner: cost.owner, extra: current}
+				watchCountByUser[cost.owner] += delta
+				watchCountTotal += delta
+
+				if maxWatchesTotal > 0 && watchCountTotal > maxWatchesTotal {
+					log.Printf("watch budget: recursive root %s now costs %d descriptors, over the configured global limit of %d", root, watchCountTotal, maxWatchesTotal)
+				}
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// pollEntry is the part of a directory entry that pollWatchStrategy diffs
+// between snapshots to decide whether a file changed. isDir is tracked so
+// diffSnapshots can ignore a directory's own mtime, which the kernel bumps
+// whenever a child is created or removed inside it -- that's already
+// reported as a Create/Remove for the child itself.
+type pollEntry struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// pollSnapshot reads dir's entries, keyed by name relative to dir. When
+// recursive is true it walks the whole subtree instead of just dir's
+// immediate children, so a recursive subscription on an NFS/FUSE mount
+// (the case pollWatchStrategy exists for) still sees changes below the
+// top level, the same as notifyWatchStrategy would.
+func pollSnapshot(dir string, recursive bool) (map[string]pollEntry, error) {
+	if !recursive {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		snap := make(map[string]pollEntry, len(entries))
+		for _, entry := range entries {
+			snap[entry.Name()] = pollEntry{size: entry.Size(), modTime: entry.ModTime(), isDir: entry.IsDir()}
+		}
+
+		return snap, nil
+	}
+
+	snap := make(map[string]pollEntry)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil || p == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return nil
+		}
+
+		snap[rel] = pollEntry{size: info.Size(), modTime: info.ModTime(), isDir: info.IsDir()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// diffSnapshots compares two pollSnapshot results and returns the Events a
+// real watcher would have produced in between: Create for a name that's
+// new, Write for a non-directory whose size or mtime changed, Remove for
+// one that's gone.
+func diffSnapshots(root string, prev, next map[string]pollEntry) []Event {
+	var events []Event
+
+	for name, entry := range next {
+		old, existed := prev[name]
+		switch {
+		case !existed:
+			events = append(events, Event{Name: filepath.Join(root, name), Op: OpCreate})
+		case !entry.isDir && old != entry:
+			events = append(events, Event{Name: filepath.Join(root, name), Op: OpWrite})
+		}
+	}
 
-		case err := <-watcher.Errors:
-			log.Println("watcher error:", err)
+	for name := range prev {
+		if _, stillThere := next[name]; !stillThere {
+			events = append(events, Event{Name: filepath.Join(root, name), Op: OpRemove})
 		}
 	}
 
+	return events
+}
+
+func pollLoop(sub *subscription, prev map[string]pollEntry) {
+	ticker := time.NewTicker(sub.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.pollStop:
+			return
+
+		case <-ticker.C:
+			next, err := pollSnapshot(sub.root, sub.recursive)
+			if err != nil {
+				log.Println("poll", sub.root, err)
+				continue
+			}
+
+			for _, ev := range diffSnapshots(sub.root, prev, next) {
+				sub.enqueue(ev)
+			}
+
+			prev = next
+		}
+	}
 }
 
 func Glob(r *kite.Request) (interface{}, error) {
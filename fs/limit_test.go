@@ -0,0 +1,71 @@
+package fs
+
+import "testing"
+
+// withLimits installs maxPerUser/maxTotal for the duration of the test and
+// restores the previous (unlimited) values and counters afterwards, since
+// these are package-level vars shared with addSubscription/removeSubscription.
+func withLimits(t *testing.T, maxPerUser, maxTotal int) {
+	t.Helper()
+
+	mu.Lock()
+	prevPerUser, prevTotal := maxWatchesPerUser, maxWatchesTotal
+	maxWatchesPerUser, maxWatchesTotal = maxPerUser, maxTotal
+	mu.Unlock()
+
+	t.Cleanup(func() {
+		mu.Lock()
+		maxWatchesPerUser, maxWatchesTotal = prevPerUser, prevTotal
+		watchCountByUser = make(map[string]int)
+		watchCountTotal = 0
+		mu.Unlock()
+	})
+}
+
+func TestCheckLimitLocked(t *testing.T) {
+	withLimits(t, 2, 3)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := checkLimitLocked("alice"); err != nil {
+		t.Fatalf("checkLimitLocked() with no watches open = %v, want nil", err)
+	}
+
+	watchCountByUser["alice"] = 2
+	watchCountTotal = 2
+
+	if err := checkLimitLocked("alice"); err == nil {
+		t.Error("checkLimitLocked() at per-user limit = nil, want an error")
+	}
+
+	if err := checkLimitLocked("bob"); err != nil {
+		t.Errorf("checkLimitLocked() for a different user under the per-user limit = %v, want nil", err)
+	}
+
+	watchCountByUser["alice"] = 1
+	watchCountTotal = 3
+
+	if err := checkLimitLocked("alice"); err == nil {
+		t.Error("checkLimitLocked() at the global limit = nil, want an error")
+	}
+}
+
+func TestWatchBudgetErrorLocked(t *testing.T) {
+	withLimits(t, 5, 10)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := watchBudgetErrorLocked("alice", 5); err != nil {
+		t.Errorf("watchBudgetErrorLocked(5) exactly at the per-user limit = %v, want nil", err)
+	}
+
+	if err := watchBudgetErrorLocked("alice", 6); err == nil {
+		t.Error("watchBudgetErrorLocked(6) over the per-user limit = nil, want an error")
+	}
+
+	if err := watchBudgetErrorLocked("alice", 11); err == nil {
+		t.Error("watchBudgetErrorLocked(11) over the global limit = nil, want an error")
+	}
+}
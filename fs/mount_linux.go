@@ -0,0 +1,31 @@
+package fs
+
+import "syscall"
+
+// Magic numbers from linux/magic.h identifying filesystem types known not
+// to reliably deliver inotify events, either because the writer is on a
+// different host (NFS, CIFS/SMB) or because the mount is itself a
+// userspace passthrough (FUSE).
+const (
+	nfsSuperMagic  = 0x6969
+	fuseSuperMagic = 0x65735546
+	cifsMagicNum   = 0xff534d42
+	smb2MagicNum   = 0xfe534d42
+)
+
+// isUnwatchableMount reports whether path lives on a filesystem where
+// inotify notifications can't be trusted, so ReadDirectory should default
+// to polling instead.
+func isUnwatchableMount(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+
+	switch int64(stat.Type) {
+	case nfsSuperMagic, fuseSuperMagic, cifsMagicNum, smb2MagicNum:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package fs
+
+// isUnwatchableMount always reports false outside Linux: statfs-based
+// filesystem-type detection isn't implemented there. That's fine as a
+// default -- FSEvents and ReadDirectoryChangesW don't share inotify's
+// blind spot for remote filesystems the way kqueue can, and callers that
+// know better can still opt into polling via PollInterval.
+func isUnwatchableMount(path string) bool {
+	return false
+}
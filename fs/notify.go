@@ -0,0 +1,39 @@
+package fs
+
+// Op describes the kind of filesystem change an Event carries. It is a
+// bitmask so a single notification can carry more than one kind of change
+// (rjeczalik/notify sometimes coalesces them before it ever reaches us).
+type Op uint32
+
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+)
+
+// Event is a single filesystem change, independent of which backend
+// produced it.
+type Event struct {
+	Name string
+	Op   Op
+}
+
+// Notifier is a filesystem watch backend. Watch starts watching path --
+// recursively, when recursive is true -- and returns a channel fed with
+// every change under it; the channel is closed once Unwatch is called for
+// the same path. Two implementations exist: one on top of
+// gopkg.in/fsnotify.v1 (used where there is no kernel-level recursive
+// watch) and one on top of github.com/rjeczalik/notify (used on darwin
+// and windows, where there is).
+type Notifier interface {
+	Watch(path string, recursive bool) (<-chan Event, error)
+	Unwatch(path string) error
+
+	// Count reports how many real OS-level watch descriptors path is
+	// currently consuming. It's 1 for rjeczalikNotifier, which watches a
+	// subtree with a single native recursive watch, but can be far larger
+	// for fsnotifyNotifier, which adds one inotify/kqueue watch per
+	// subdirectory under path.
+	Count(path string) int
+}
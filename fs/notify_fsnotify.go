@@ -0,0 +1,264 @@
+// +build !darwin,!windows
+
+package fs
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/koding/klient/Godeps/_workspace/src/gopkg.in/fsnotify.v1"
+)
+
+// fsnotifyNotifier implements Notifier on top of gopkg.in/fsnotify.v1,
+// which only ever watches a single directory. A recursive Watch is
+// emulated by walking the subtree up front, adding one inotify/kqueue
+// watch per directory, and tracking directory creation/removal
+// afterwards so the watch set stays in sync.
+type fsnotifyNotifier struct {
+	watcher *fsnotify.Watcher
+
+	mu    sync.Mutex
+	roots map[string]map[string]bool // root -> dirs watched on its behalf
+	refs  map[string]int             // dir -> number of roots watching it
+	out   map[string]chan Event      // root -> channel handed back to the caller
+}
+
+func newNotifier() Notifier {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n := &fsnotifyNotifier{
+		watcher: w,
+		roots:   make(map[string]map[string]bool),
+		refs:    make(map[string]int),
+		out:     make(map[string]chan Event),
+	}
+
+	go n.dispatch()
+
+	return n
+}
+
+func (n *fsnotifyNotifier) Watch(root string, recursive bool) (<-chan Event, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out := make(chan Event, 64)
+	n.out[root] = out
+	n.roots[root] = make(map[string]bool)
+
+	if err := n.addDirLocked(root, root); err != nil {
+		return nil, err
+	}
+
+	if !recursive {
+		return out, nil
+	}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil || p == root || !info.IsDir() {
+			return nil
+		}
+
+		if addErr := n.addDirLocked(root, p); addErr != nil {
+			log.Println("watch subtree", p, addErr)
+			return nil
+		}
+
+		n.synthesizeAddedLocked(root, p)
+
+		return nil
+	})
+
+	return out, err
+}
+
+func (n *fsnotifyNotifier) Unwatch(root string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for dir := range n.roots[root] {
+		n.removeDirLocked(root, dir)
+	}
+	delete(n.roots, root)
+
+	// Deleting from n.out before closing means every send, wherever it
+	// comes from, goes through n.send -- which takes the same lock and
+	// looks the channel up fresh -- so none can race a send against this
+	// close.
+	if out, ok := n.out[root]; ok {
+		delete(n.out, root)
+		close(out)
+	}
+
+	return nil
+}
+
+// send delivers ev on root's output channel, if it's still open. It is the
+// only place that writes to n.out's channels, and it always does so under
+// n.mu -- the same lock Unwatch uses to remove and close them -- so a send
+// can never race a close into a "send on closed channel" panic, no matter
+// which goroutine (handle, or one of synthesizeAddedLocked's) is doing the
+// sending.
+func (n *fsnotifyNotifier) send(root string, ev Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if out, ok := n.out[root]; ok {
+		out <- ev
+	}
+}
+
+func (n *fsnotifyNotifier) addDirLocked(root, dir string) error {
+	if n.refs[dir] == 0 {
+		if err := n.watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	n.refs[dir]++
+	n.roots[root][dir] = true
+
+	return nil
+}
+
+func (n *fsnotifyNotifier) removeDirLocked(root, dir string) {
+	if !n.roots[root][dir] {
+		return
+	}
+
+	delete(n.roots[root], dir)
+
+	n.refs[dir]--
+	if n.refs[dir] <= 0 {
+		delete(n.refs, dir)
+		if err := n.watcher.Remove(dir); err != nil {
+			log.Println("unwatch", dir, err)
+		}
+	}
+}
+
+// synthesizeAddedLocked announces every entry already present in dir as a
+// Create event. It exists because a directory can be populated between
+// the moment fsnotify.Create fires for it and the moment we manage to add
+// a watch on it -- the classic inotify/kqueue new-directory race.
+func (n *fsnotifyNotifier) synthesizeAddedLocked(root, dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		go n.send(root, Event{Name: name, Op: OpCreate})
+	}
+}
+
+func (n *fsnotifyNotifier) dispatch() {
+	for {
+		select {
+		case ev := <-n.watcher.Events:
+			n.handle(ev)
+		case err := <-n.watcher.Errors:
+			log.Println("watcher error:", err)
+		}
+	}
+}
+
+func (n *fsnotifyNotifier) handle(ev fsnotify.Event) {
+	dir := filepath.Dir(ev.Name)
+
+	n.mu.Lock()
+	var roots []string
+	for root, dirs := range n.roots {
+		if dirs[dir] {
+			roots = append(roots, root)
+		}
+	}
+	n.mu.Unlock()
+
+	op := translateFsnotifyOp(ev.Op)
+
+	for _, root := range roots {
+		// keep a recursive root's watch set in sync with directories
+		// being created/removed under it.
+		if ev.Op&fsnotify.Create == fsnotify.Create {
+			if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+				n.addSubtree(root, ev.Name)
+			}
+		}
+		if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			n.removeSubtree(root, ev.Name)
+		}
+
+		n.send(root, Event{Name: ev.Name, Op: op})
+	}
+}
+
+// Count reports how many real inotify/kqueue watches root is currently
+// consuming -- 1 for a non-recursive Watch, one per subdirectory walked
+// for a recursive one.
+func (n *fsnotifyNotifier) Count(root string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.roots[root])
+}
+
+func (n *fsnotifyNotifier) addSubtree(root, dir string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil || !info.IsDir() {
+			return nil
+		}
+
+		if addErr := n.addDirLocked(root, p); addErr != nil {
+			log.Println("watch subtree", p, addErr)
+			return nil
+		}
+
+		n.synthesizeAddedLocked(root, p)
+
+		return nil
+	})
+	if err != nil {
+		log.Println("watch subtree walk", dir, err)
+	}
+}
+
+func (n *fsnotifyNotifier) removeSubtree(root, dir string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	prefix := dir + string(os.PathSeparator)
+	for watched := range n.roots[root] {
+		if watched == dir || strings.HasPrefix(watched, prefix) {
+			n.removeDirLocked(root, watched)
+		}
+	}
+}
+
+func translateFsnotifyOp(op fsnotify.Op) Op {
+	var out Op
+	if op&fsnotify.Create == fsnotify.Create {
+		out |= OpCreate
+	}
+	if op&fsnotify.Write == fsnotify.Write {
+		out |= OpWrite
+	}
+	if op&fsnotify.Remove == fsnotify.Remove {
+		out |= OpRemove
+	}
+	if op&fsnotify.Rename == fsnotify.Rename {
+		out |= OpRename
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+// +build darwin windows
+
+package fs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/koding/klient/Godeps/_workspace/src/github.com/rjeczalik/notify"
+)
+
+// rjeczalikNotifier implements Notifier on top of rjeczalik/notify, which
+// watches a subtree natively through the OS (FSEvents on darwin,
+// ReadDirectoryChangesW on windows) instead of adding one inotify-style
+// descriptor per subdirectory. Appending "/..." to the watched path is
+// what rjeczalik/notify uses to mean "recursively".
+type rjeczalikNotifier struct {
+	mu  sync.Mutex
+	raw map[string]chan notify.EventInfo
+}
+
+func newNotifier() Notifier {
+	return &rjeczalikNotifier{
+		raw: make(map[string]chan notify.EventInfo),
+	}
+}
+
+func (n *rjeczalikNotifier) Watch(path string, recursive bool) (<-chan Event, error) {
+	target := path
+	if recursive {
+		target = filepath.Join(path, "...")
+	}
+
+	raw := make(chan notify.EventInfo, 64)
+	if err := notify.Watch(target, raw, notify.Create, notify.Write, notify.Remove, notify.Rename); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	n.raw[path] = raw
+	n.mu.Unlock()
+
+	out := make(chan Event, 64)
+	go func() {
+		for ei := range raw {
+			out <- Event{Name: ei.Path(), Op: translateNotifyOp(ei.Event())}
+		}
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// Count always reports 1: rjeczalik/notify watches a recursive subtree
+// with a single native kernel-level watch (FSEvents/ReadDirectoryChangesW),
+// not one descriptor per subdirectory the way fsnotify does.
+func (n *rjeczalikNotifier) Count(path string) int {
+	return 1
+}
+
+func (n *rjeczalikNotifier) Unwatch(path string) error {
+	n.mu.Lock()
+	raw, ok := n.raw[path]
+	delete(n.raw, path)
+	n.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	notify.Stop(raw)
+	close(raw)
+
+	return nil
+}
+
+func translateNotifyOp(ev notify.Event) Op {
+	var out Op
+	if ev&notify.Create != 0 {
+		out |= OpCreate
+	}
+	if ev&notify.Write != 0 {
+		out |= OpWrite
+	}
+	if ev&notify.Remove != 0 {
+		out |= OpRemove
+	}
+	if ev&notify.Rename != 0 {
+		out |= OpRename
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	root := "/watched"
+	now := time.Unix(1700000000, 0)
+	later := now.Add(time.Second)
+
+	tests := []struct {
+		name string
+		prev map[string]pollEntry
+		next map[string]pollEntry
+		want map[string]Op // path -> expected Op
+	}{
+		{
+			name: "new entry is a create",
+			prev: map[string]pollEntry{},
+			next: map[string]pollEntry{"a": {size: 1, modTime: now}},
+			want: map[string]Op{filepath.Join(root, "a"): OpCreate},
+		},
+		{
+			name: "changed size is a write",
+			prev: map[string]pollEntry{"a": {size: 1, modTime: now}},
+			next: map[string]pollEntry{"a": {size: 2, modTime: now}},
+			want: map[string]Op{filepath.Join(root, "a"): OpWrite},
+		},
+		{
+			name: "changed mtime is a write",
+			prev: map[string]pollEntry{"a": {size: 1, modTime: now}},
+			next: map[string]pollEntry{"a": {size: 1, modTime: later}},
+			want: map[string]Op{filepath.Join(root, "a"): OpWrite},
+		},
+		{
+			name: "missing entry is a remove",
+			prev: map[string]pollEntry{"a": {size: 1, modTime: now}},
+			next: map[string]pollEntry{},
+			want: map[string]Op{filepath.Join(root, "a"): OpRemove},
+		},
+		{
+			name: "unchanged entry produces nothing",
+			prev: map[string]pollEntry{"a": {size: 1, modTime: now}},
+			next: map[string]pollEntry{"a": {size: 1, modTime: now}},
+			want: map[string]Op{},
+		},
+		{
+			name: "nested path under a recursive snapshot",
+			prev: map[string]pollEntry{},
+			next: map[string]pollEntry{filepath.Join("sub", "a"): {size: 1, modTime: now}},
+			want: map[string]Op{filepath.Join(root, "sub", "a"): OpCreate},
+		},
+		{
+			name: "a directory's own mtime change is not a write -- its child's create/remove already covers it",
+			prev: map[string]pollEntry{"sub": {modTime: now, isDir: true}},
+			next: map[string]pollEntry{
+				"sub":                           {modTime: later, isDir: true},
+				filepath.Join("sub", "newfile"): {size: 1, modTime: later},
+			},
+			want: map[string]Op{filepath.Join(root, "sub", "newfile"): OpCreate},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffSnapshots(root, tt.prev, tt.next)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("diffSnapshots() = %d events, want %d: %+v", len(got), len(tt.want), got)
+			}
+
+			for _, ev := range got {
+				want, ok := tt.want[ev.Name]
+				if !ok {
+					t.Errorf("unexpected event for %q", ev.Name)
+					continue
+				}
+				if ev.Op != want {
+					t.Errorf("event for %q: Op = %v, want %v", ev.Name, ev.Op, want)
+				}
+			}
+		})
+	}
+}
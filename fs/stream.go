@@ -0,0 +1,276 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/koding/klient/Godeps/_workspace/src/github.com/koding/kite"
+	"github.com/koding/klient/Godeps/_workspace/src/github.com/koding/kite/dnode"
+)
+
+// streamChunkSize is the amount of raw file data read per chunk, before
+// base64 encoding. ReadFile/WriteFile marshal a whole file
+// through a single dnode call, which OOMs the process and stalls the
+// websocket on multi-hundred-MB files; the *Stream variants below move
+// only this much at a time.
+const streamChunkSize = 256 * 1024
+
+// ReadFileStream reads a file in streamChunkSize pieces, calling OnChunk
+// with each base64-encoded piece and waiting for the client to ack it
+// before reading the next one. OnDone is called once with a sha256 of
+// everything sent, for integrity verification on the client side.
+func ReadFileStream(r *kite.Request) (interface{}, error) {
+	var params struct {
+		Path    string
+		Offset  int64
+		Length  int64
+		OnChunk dnode.Function
+		OnDone  dnode.Function
+	}
+
+	if r.Args.One().Unmarshal(&params) != nil || params.Path == "" || !params.OnChunk.IsValid() {
+		return nil, errors.New("{ path: [string], offset: [integer], length: [integer], onChunk: [function], onDone: [function] }")
+	}
+
+	f, err := os.Open(params.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Offset > 0 {
+		if _, err := f.Seek(params.Offset, os.SEEK_SET); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	cancelled := make(chan struct{})
+	var cancelOnce sync.Once
+
+	go streamRead(f, params.Length, params.OnChunk, params.OnDone, cancelled)
+
+	return map[string]interface{}{
+		"cancel": dnode.Callback(func(r *dnode.Partial) {
+			cancelOnce.Do(func() { close(cancelled) })
+		}),
+	}, nil
+}
+
+// chunkSender hands one base64-encoded chunk to the client and calls ack
+// once the client has confirmed receiving it.
+type chunkSender func(data string, ack func())
+
+func streamRead(f *os.File, length int64, onChunk, onDone dnode.Function, cancelled <-chan struct{}) {
+	defer f.Close()
+
+	send := func(data string, ack func()) {
+		onChunk.Call(data, dnode.Callback(func(r *dnode.Partial) {
+			ack()
+		}))
+	}
+
+	sum, sent, wasCancelled := readChunks(f, length, streamChunkSize, send, cancelled)
+	if wasCancelled {
+		return
+	}
+
+	onDone.Call(map[string]interface{}{
+		"sha256": sum,
+		"bytes":  sent,
+	})
+}
+
+// readChunks is the chunking loop behind streamRead, pulled out so it can
+// be driven with a plain send func and a small chunkSize in tests instead
+// of a real dnode.Function and streamChunkSize-sized fixtures. It reads r
+// in chunkSize pieces (or less, to honor length, when length > 0), base64-
+// encoding and handing each one to send, and blocks on send's ack before
+// reading the next -- the backpressure that keeps a slow client from
+// being flooded. It stops as soon as cancelled is closed, whether that
+// happens between chunks or while waiting on an ack, and reports that via
+// the cancelled return value so the caller can skip onDone the same way a
+// cancelled transfer always has.
+func readChunks(r io.Reader, length int64, chunkSize int, send chunkSender, cancelled <-chan struct{}) (sha256Hex string, sent int64, wasCancelled bool) {
+	hasher := sha256.New()
+	buf := make([]byte, chunkSize)
+
+	for {
+		select {
+		case <-cancelled:
+			return hex.EncodeToString(hasher.Sum(nil)), sent, true
+		default:
+		}
+
+		want := len(buf)
+		if length > 0 {
+			if remaining := length - sent; remaining < int64(want) {
+				want = int(remaining)
+			}
+		}
+		if want <= 0 {
+			break
+		}
+
+		n, readErr := r.Read(buf[:want])
+		if n > 0 {
+			hasher.Write(buf[:n])
+			sent += int64(n)
+
+			acked := make(chan struct{})
+			send(base64.StdEncoding.EncodeToString(buf[:n]), func() {
+				close(acked)
+			})
+
+			select {
+			case <-acked:
+			case <-cancelled:
+				return hex.EncodeToString(hasher.Sum(nil)), sent, true
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			log.Println("stream read", readErr)
+			break
+		}
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), sent, false
+}
+
+// WriteFileStream requests a file's content from the client piece by
+// piece, calling OnRequestChunk once per piece and
+// blocking on its callback until the client supplies one (or signals
+// Done). OnDone reports a sha256 of everything written.
+func WriteFileStream(r *kite.Request) (interface{}, error) {
+	var params struct {
+		Path           string
+		Append         bool
+		Mode           os.FileMode
+		OnRequestChunk dnode.Function
+		OnDone         dnode.Function
+	}
+
+	if r.Args.One().Unmarshal(&params) != nil || params.Path == "" || !params.OnRequestChunk.IsValid() {
+		return nil, errors.New("{ path: [string], append: [bool], mode: [integer], onRequestChunk: [function], onDone: [function] }")
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if params.Append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	mode := params.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+
+	f, err := os.OpenFile(params.Path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelled := make(chan struct{})
+	var cancelOnce sync.Once
+
+	go streamWrite(f, params.OnRequestChunk, params.OnDone, cancelled)
+
+	return map[string]interface{}{
+		"cancel": dnode.Callback(func(r *dnode.Partial) {
+			cancelOnce.Do(func() { close(cancelled) })
+		}),
+	}, nil
+}
+
+// chunkReceiver pulls the next chunk from the client. ok is false when the
+// wait for that chunk was cut short by cancellation rather than an actual
+// chunk (or Done) arriving.
+type chunkReceiver func() (data string, done bool, ok bool)
+
+func streamWrite(f *os.File, onRequestChunk, onDone dnode.Function, cancelled <-chan struct{}) {
+	defer f.Close()
+
+	type chunk struct {
+		Data string
+		Done bool
+	}
+
+	receive := func() (string, bool, bool) {
+		received := make(chan chunk, 1)
+		onRequestChunk.Call(dnode.Callback(func(r *dnode.Partial) {
+			var c chunk
+			r.Unmarshal(&c)
+			received <- c
+		}))
+
+		select {
+		case c := <-received:
+			return c.Data, c.Done, true
+		case <-cancelled:
+			return "", false, false
+		}
+	}
+
+	sum, written, wasCancelled := writeChunks(f, receive, cancelled)
+	if wasCancelled {
+		return
+	}
+
+	onDone.Call(map[string]interface{}{
+		"sha256": sum,
+		"bytes":  written,
+	})
+}
+
+// writeChunks is the chunking loop behind streamWrite, pulled out so it
+// can be driven with a plain receive func in tests instead of a real
+// dnode.Function. It pulls chunks from receive until it gets Done (or
+// receive reports cancellation), base64-decoding and writing each one to
+// w and hashing it as it goes. It reports cancellation via the cancelled
+// return value so the caller can skip onDone the same way a cancelled
+// transfer always has.
+func writeChunks(w io.Writer, receive chunkReceiver, cancelled <-chan struct{}) (sha256Hex string, written int64, wasCancelled bool) {
+	hasher := sha256.New()
+
+	for {
+		select {
+		case <-cancelled:
+			return hex.EncodeToString(hasher.Sum(nil)), written, true
+		default:
+		}
+
+		data, done, ok := receive()
+		if !ok {
+			return hex.EncodeToString(hasher.Sum(nil)), written, true
+		}
+		if done {
+			break
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			log.Println("stream write decode", err)
+			break
+		}
+
+		if _, err := w.Write(raw); err != nil {
+			log.Println("stream write", err)
+			break
+		}
+
+		hasher.Write(raw)
+		written += int64(len(raw))
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), written, false
+}
@@ -0,0 +1,215 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadChunksSplitsAndHashes(t *testing.T) {
+	data := "the quick brown fox jumps over the lazy dog"
+	r := strings.NewReader(data)
+
+	var chunks []string
+	send := func(chunk string, ack func()) {
+		chunks = append(chunks, chunk)
+		ack()
+	}
+
+	sum, sent, _ := readChunks(r, 0, 8, send, nil)
+
+	if sent != int64(len(data)) {
+		t.Fatalf("sent = %d, want %d", sent, len(data))
+	}
+
+	if want := (len(data) + 7) / 8; len(chunks) != want {
+		t.Fatalf("got %d chunks, want %d", len(chunks), want)
+	}
+
+	var reassembled []byte
+	for _, c := range chunks {
+		raw, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			t.Fatalf("chunk is not valid base64: %v", err)
+		}
+		reassembled = append(reassembled, raw...)
+	}
+	if string(reassembled) != data {
+		t.Fatalf("reassembled data = %q, want %q", reassembled, data)
+	}
+
+	wantSum := sha256.Sum256([]byte(data))
+	if sum != hex.EncodeToString(wantSum[:]) {
+		t.Fatalf("sha256 = %s, want %s", sum, hex.EncodeToString(wantSum[:]))
+	}
+}
+
+func TestReadChunksHonorsLength(t *testing.T) {
+	r := strings.NewReader("0123456789")
+
+	var chunks []string
+	send := func(chunk string, ack func()) {
+		chunks = append(chunks, chunk)
+		ack()
+	}
+
+	sum, sent, _ := readChunks(r, 4, 8, send, nil)
+
+	if sent != 4 {
+		t.Fatalf("sent = %d, want 4", sent)
+	}
+
+	wantSum := sha256.Sum256([]byte("0123"))
+	if sum != hex.EncodeToString(wantSum[:]) {
+		t.Fatalf("sha256 = %s, want %s", sum, hex.EncodeToString(wantSum[:]))
+	}
+}
+
+// TestReadChunksWaitsForAck checks the backpressure readChunks is for:
+// it must not hand the next chunk to send until the previous one's ack
+// has actually fired.
+func TestReadChunksWaitsForAck(t *testing.T) {
+	r := strings.NewReader(strings.Repeat("a", 20))
+
+	var calls int32
+	acks := make(chan func(), 10)
+	send := func(chunk string, ack func()) {
+		atomic.AddInt32(&calls, 1)
+		acks <- ack
+	}
+
+	done := make(chan struct{})
+	go func() {
+		readChunks(r, 0, 5, send, nil)
+		close(done)
+	}()
+
+	ack := <-acks
+
+	select {
+	case <-done:
+		t.Fatal("readChunks returned before the first chunk was acked")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("send called %d times before the first ack, want 1", n)
+	}
+	ack()
+
+	for i := 0; i < 3; i++ {
+		(<-acks)()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("readChunks did not return after every chunk was acked")
+	}
+}
+
+// TestReadChunksCancellation checks that readChunks returns as soon as
+// cancelled is closed, even while it's still waiting on a chunk's ack
+// that will never come.
+func TestReadChunksCancellation(t *testing.T) {
+	r := strings.NewReader(strings.Repeat("a", 20))
+
+	cancelled := make(chan struct{})
+	var calls int32
+	send := func(chunk string, ack func()) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(cancelled)
+		}
+	}
+
+	done := make(chan struct{})
+	var sent int64
+	go func() {
+		_, sent, _ = readChunks(r, 0, 5, send, cancelled)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("readChunks did not return after cancellation")
+	}
+
+	if sent != 5 {
+		t.Fatalf("sent = %d, want 5 (only the chunk already handed to send)", sent)
+	}
+	if calls != 1 {
+		t.Fatalf("send called %d times, want 1", calls)
+	}
+}
+
+func TestWriteChunksAssemblesAndHashes(t *testing.T) {
+	pieces := []string{"hello ", "world"}
+	var idx int
+	receive := func() (string, bool, bool) {
+		if idx >= len(pieces) {
+			return "", true, true
+		}
+		p := pieces[idx]
+		idx++
+		return base64.StdEncoding.EncodeToString([]byte(p)), false, true
+	}
+
+	var buf bytes.Buffer
+	sum, written, _ := writeChunks(&buf, receive, nil)
+
+	if want := "hello world"; buf.String() != want {
+		t.Fatalf("written data = %q, want %q", buf.String(), want)
+	}
+	if written != int64(buf.Len()) {
+		t.Fatalf("written = %d, want %d", written, buf.Len())
+	}
+
+	wantSum := sha256.Sum256([]byte("hello world"))
+	if sum != hex.EncodeToString(wantSum[:]) {
+		t.Fatalf("sha256 = %s, want %s", sum, hex.EncodeToString(wantSum[:]))
+	}
+}
+
+func TestWriteChunksCancellationDuringReceive(t *testing.T) {
+	var calls int32
+	receive := func() (string, bool, bool) {
+		atomic.AddInt32(&calls, 1)
+		return "", false, false
+	}
+
+	var buf bytes.Buffer
+	_, written, _ := writeChunks(&buf, receive, nil)
+
+	if written != 0 {
+		t.Fatalf("written = %d, want 0 after cancellation", written)
+	}
+	if calls != 1 {
+		t.Fatalf("receive called %d times, want 1", calls)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("buf = %q, want empty", buf.String())
+	}
+}
+
+func TestWriteChunksCancellationBeforeReceive(t *testing.T) {
+	cancelled := make(chan struct{})
+	close(cancelled)
+
+	called := false
+	receive := func() (string, bool, bool) {
+		called = true
+		return "", false, true
+	}
+
+	var buf bytes.Buffer
+	writeChunks(&buf, receive, cancelled)
+
+	if called {
+		t.Fatal("receive was called after cancellation had already happened")
+	}
+}